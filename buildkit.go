@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// buildKitEnviron returns the environment additions needed to run the
+// build through BuildKit instead of the classic builder.
+func buildKitEnviron() []string {
+	return []string{"DOCKER_BUILDKIT=1"}
+}
+
+// pullCacheFrom best-effort pulls every cache-from ref so its layers are
+// available locally to seed the build. Failures are ignored since the
+// very first build of an image has no prior cache to pull.
+func pullCacheFrom(refs []string, dir string) {
+	for _, ref := range refs {
+		cmd := exec.Command("/usr/bin/docker", "pull", ref)
+		cmd.Dir = dir
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		trace(cmd)
+		cmd.Run()
+	}
+}
+
+// buildArgs returns the extra docker build flags common to every build
+// path: --build-arg, --label, --target, and (when BuildKit is enabled)
+// the inline cache import flags. --cache-to is a buildx-only flag (the
+// classic builder rejects it even when BuildKit is enabled) so it is
+// emitted only by buildxBuild, not here.
+func (d *Docker) buildArgs() []string {
+	var args []string
+
+	for k, v := range d.BuildArgs {
+		args = append(args, "--build-arg", fmt.Sprintf("%s=%s", k, v))
+	}
+	for k, v := range d.Labels {
+		args = append(args, "--label", fmt.Sprintf("%s=%s", k, v))
+	}
+	if len(d.Target) != 0 {
+		args = append(args, "--target", d.Target)
+	}
+
+	if d.BuildKit {
+		for _, ref := range d.CacheFrom {
+			args = append(args, "--cache-from", ref)
+		}
+		if len(d.CacheFrom) != 0 {
+			args = append(args, "--build-arg", "BUILDKIT_INLINE_CACHE=1")
+		}
+	}
+
+	return args
+}
+
+// cacheToArgs returns the buildx-only --cache-to flags for registry-based
+// cache export. They are added only when BuildKit is enabled: to the
+// multi-arch `docker buildx build`, and to the single-arch build, which
+// then runs through `docker buildx build` when CacheTo is also set.
+func (d *Docker) cacheToArgs() []string {
+	var args []string
+	for _, ref := range d.CacheTo {
+		args = append(args, "--cache-to", fmt.Sprintf("type=registry,ref=%s,mode=max", ref))
+	}
+	return args
+}
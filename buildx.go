@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// buildxBuilderName is the dedicated buildx builder instance the plugin
+// creates so multi-arch builds don't collide with any builder already
+// configured on the host.
+const buildxBuilderName = "drone-docker"
+
+// hasBuildx reports whether the docker CLI has the buildx plugin
+// available. Older daemons fall back to `docker build` per platform
+// plus `docker manifest` to assemble the manifest list.
+func hasBuildx() bool {
+	cmd := exec.Command("/usr/bin/docker", "buildx", "version")
+	return cmd.Run() == nil
+}
+
+// registerQEMU installs the QEMU binfmt_misc handlers so the daemon can
+// execute foreign-architecture binaries while cross-building.
+func registerQEMU() error {
+	cmd := exec.Command("/usr/bin/docker", "run", "--rm", "--privileged",
+		"tonistiigi/binfmt", "--install", "all")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	trace(cmd)
+	return cmd.Run()
+}
+
+// ensureBuilder creates (or reuses) the plugin's buildx builder and
+// bootstraps it so it is ready to build.
+func ensureBuilder() error {
+	cmd := exec.Command("/usr/bin/docker", "buildx", "create",
+		"--name", buildxBuilderName, "--use")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	trace(cmd)
+	// a builder with this name may already exist from a previous run on
+	// the same host; that's not fatal, fall through and select it.
+	cmd.Run()
+
+	cmd = exec.Command("/usr/bin/docker", "buildx", "use", buildxBuilderName)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	trace(cmd)
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+
+	cmd = exec.Command("/usr/bin/docker", "buildx", "inspect", "--bootstrap")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	trace(cmd)
+	return cmd.Run()
+}
+
+// buildxBuild builds a single manifest-list image covering every
+// requested platform and pushes it to every (registry, tag) tuple in
+// one shot. The returned map gives the pushed digest for each tag in
+// the primary (first) registry, resolved afterward via `docker buildx
+// imagetools inspect` since a manifest list is never loaded into the
+// local image store.
+func buildxBuild(vargs *Docker, registries []RegistryConfig, dir string) (map[string]string, error) {
+	args := []string{"buildx", "build",
+		"--platform=" + strings.Join(vargs.Platforms, ","),
+		"--push",
+		"-f", vargs.File,
+	}
+	for _, r := range registries {
+		for _, tag := range vargs.Tag.Slice() {
+			args = append(args, "-t", fmt.Sprintf("%s:%s", r.repo(vargs.Repo), tag))
+		}
+	}
+	args = append(args, vargs.buildArgs()...)
+	if vargs.BuildKit {
+		args = append(args, vargs.cacheToArgs()...)
+	}
+	args = append(args, vargs.Context)
+
+	cmd := exec.Command("/usr/bin/docker", args...)
+	cmd.Dir = dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	trace(cmd)
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+
+	repo := registries[0].repo(vargs.Repo)
+	digests := map[string]string{}
+	for _, tag := range vargs.Tag.Slice() {
+		digest, err := remoteDigest(fmt.Sprintf("%s:%s", repo, tag))
+		if err != nil {
+			continue
+		}
+		digests[tag] = digest
+	}
+	return digests, nil
+}
+
+// buildManifestFallback builds each platform individually with plain
+// `docker build`, pushes the per-arch images to every registry under
+// arch-suffixed tags, then stitches them into a manifest list per
+// (registry, tag) using the `docker manifest` tooling. Used when buildx
+// is not available. The returned map gives the pushed manifest-list
+// digest for each tag in the primary (first) registry, read directly
+// off `docker manifest push`'s stdout rather than via `buildx imagetools
+// inspect`, which this fallback path by definition can't rely on.
+func buildManifestFallback(vargs *Docker, registries []RegistryConfig, dir string) (map[string]string, error) {
+	digests := map[string]string{}
+
+	for _, tag := range vargs.Tag.Slice() {
+		archRefs := make([][]string, len(registries))
+
+		for _, platform := range vargs.Platforms {
+			arch := strings.NewReplacer("/", "-").Replace(platform)
+			local := fmt.Sprintf("%s:%s-%s-build", vargs.buildRepo(), tag, arch)
+
+			buildArgs := []string{"build", "--pull=true", "--rm=true",
+				"--platform", platform, "-f", vargs.File, "-t", local}
+			buildArgs = append(buildArgs, vargs.buildArgs()...)
+			buildArgs = append(buildArgs, vargs.Context)
+			cmd := exec.Command("/usr/bin/docker", buildArgs...)
+			cmd.Dir = dir
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			if vargs.BuildKit {
+				cmd.Env = append(os.Environ(), buildKitEnviron()...)
+			}
+			trace(cmd)
+			if err := cmd.Run(); err != nil {
+				return nil, err
+			}
+
+			for i, r := range registries {
+				ref := fmt.Sprintf("%s:%s-%s", r.repo(vargs.Repo), tag, arch)
+
+				cmd := exec.Command("/usr/bin/docker", "tag", local, ref)
+				cmd.Dir = dir
+				cmd.Stdout = os.Stdout
+				cmd.Stderr = os.Stderr
+				trace(cmd)
+				if err := cmd.Run(); err != nil {
+					return nil, err
+				}
+
+				cmd = exec.Command("/usr/bin/docker", "push", ref)
+				cmd.Dir = dir
+				cmd.Stdout = os.Stdout
+				cmd.Stderr = os.Stderr
+				trace(cmd)
+				if err := cmd.Run(); err != nil {
+					return nil, err
+				}
+
+				archRefs[i] = append(archRefs[i], ref)
+			}
+		}
+
+		for i, r := range registries {
+			name := fmt.Sprintf("%s:%s", r.repo(vargs.Repo), tag)
+			args := append([]string{"manifest", "create", name}, archRefs[i]...)
+			cmd := exec.Command("/usr/bin/docker", args...)
+			cmd.Dir = dir
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			trace(cmd)
+			if err := cmd.Run(); err != nil {
+				return nil, err
+			}
+
+			cmd = exec.Command("/usr/bin/docker", "manifest", "push", "--purge", name)
+			cmd.Dir = dir
+			cmd.Stderr = os.Stderr
+			trace(cmd)
+			out, err := cmd.Output()
+			if err != nil {
+				return nil, err
+			}
+			fmt.Print(string(out))
+			if i == 0 {
+				digests[tag] = strings.TrimSpace(string(out))
+			}
+		}
+	}
+	return digests, nil
+}
+
+// buildMultiArch builds, assembles and pushes a manifest-list image for
+// every platform in vargs.Platforms to every configured registry,
+// preferring buildx and falling back to `docker manifest` on daemons
+// that don't have it. The returned map gives the pushed digest for each
+// tag in the primary (first) registry.
+func buildMultiArch(vargs *Docker, registries []RegistryConfig, dir string) (map[string]string, error) {
+	if err := registerQEMU(); err != nil {
+		return nil, err
+	}
+
+	if vargs.BuildKit {
+		pullCacheFrom(vargs.CacheFrom, dir)
+	}
+
+	if hasBuildx() {
+		if err := ensureBuilder(); err != nil {
+			return nil, err
+		}
+		return buildxBuild(vargs, registries, dir)
+	}
+
+	fmt.Println("buildx not available, falling back to docker manifest")
+	return buildManifestFallback(vargs, registries, dir)
+}
@@ -19,20 +19,55 @@ type Archive struct {
 }
 
 type Docker struct {
-	Storage  string   `json:"storage_driver"`
-	Registry string   `json:"registry"`
-	Insecure bool     `json:"insecure"`
-	Username string   `json:"username"`
-	Password string   `json:"password"`
-	Email    string   `json:"email"`
-	Auth     string   `json:"auth"`
-	Repo     string   `json:"repo"`
-	Tag      StrSlice `json:"tag"`
-	File     string   `json:"file"`
-	Cert     string   `json:"cert"`
-	Context  string   `json:"context"`
-	Dns      []string `json:"dns"`
-	Archive  Archive  `json:"archive"`
+	Storage  string       `json:"storage_driver"`
+	Registry string       `json:"registry"`
+	Insecure bool         `json:"insecure"`
+	Username string       `json:"username"`
+	Password string       `json:"password"`
+	Email    string       `json:"email"`
+	Auth     string       `json:"auth"`
+	Repo     string       `json:"repo"`
+	Tag      StrSlice     `json:"tag"`
+	File     string       `json:"file"`
+	Cert     string       `json:"cert"`
+	Context  string       `json:"context"`
+	Dns      []string     `json:"dns"`
+	Archive  Archive      `json:"archive"`
+	Trust    ContentTrust `json:"trust"`
+
+	// Registries lists the registries (and optional per-registry repo
+	// override) the built image should be tagged and pushed to. When
+	// empty, the top-level Registry/Username/Password/Repo fields above
+	// are used to synthesize a single entry.
+	Registries []RegistryConfig `json:"registries"`
+
+	// Platforms, when set, switches the build from a single `docker
+	// build` to a multi-arch buildx build producing a manifest list,
+	// e.g. []string{"linux/amd64", "linux/arm64", "linux/arm/v7"}.
+	Platforms []string `json:"platforms"`
+
+	// Output overrides the path of the structured build summary written
+	// after a successful push (default: <workspace>/.docker.json).
+	// DisableOutput skips writing it entirely.
+	Output        string `json:"output"`
+	DisableOutput bool   `json:"disable_output"`
+
+	// BuildKit switches the build to the BuildKit backend and enables
+	// registry-based cache import/export via CacheFrom/CacheTo.
+	BuildKit  bool     `json:"buildkit"`
+	CacheFrom []string `json:"cache_from"`
+	CacheTo   []string `json:"cache_to"`
+
+	// BuildArgs, Labels and Target are passed straight through to
+	// `docker build`/`docker buildx build` as --build-arg, --label and
+	// --target respectively.
+	BuildArgs map[string]string `json:"build_args"`
+	Labels    map[string]string `json:"labels"`
+	Target    string            `json:"target"`
+
+	// Scan gates the push behind a vulnerability scan of the image this
+	// plugin just built.
+	Scan Scan `json:"scan"`
 }
 
 func main() {
@@ -54,7 +89,7 @@ func main() {
 
 	// Set the Registry value
 	if len(vargs.Registry) == 0 {
-		vargs.Registry = "https://index.docker.io/v1/"
+		vargs.Registry = defaultRegistry
 	}
 	// Set the Dockerfile name
 	if len(vargs.File) == 0 {
@@ -75,16 +110,34 @@ func main() {
 		}
 	}
 
-	// install the cert if provided
-	if len(vargs.Cert) != 0 {
-		uri, err := url.Parse(vargs.Registry)
+	// install any inline Notary keys so the docker client can sign
+	// and verify with them, and make sure they are wiped on exit.
+	if vargs.Trust.Enable {
+		keys, err := vargs.Trust.installKeys()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer cleanupKeys(keys)
+	}
+
+	// resolve the registries this build pushes to, falling back to the
+	// legacy top-level fields when Registries is not set.
+	registries := vargs.registries()
+
+	// install the cert for every registry that provides one
+	for _, r := range registries {
+		if len(r.Cert) == 0 {
+			continue
+		}
+		uri, err := url.Parse(r.Registry)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(0)
 		}
 		os.MkdirAll(filepath.Join("/etc/docker/certs.d/", uri.Host), 0711)
 		err = ioutil.WriteFile(filepath.Join("/etc/docker/certs.d/", uri.Host, "ca.crt"),
-			[]byte(vargs.Cert), 0644)
+			[]byte(r.Cert), 0644)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(0)
@@ -97,8 +150,10 @@ func main() {
 		if len(vargs.Storage) != 0 {
 			args = append(args, "-s", vargs.Storage)
 		}
-		if vargs.Insecure && len(vargs.Registry) != 0 {
-			args = append(args, "--insecure-registry", vargs.Registry)
+		for _, r := range registries {
+			if r.Insecure && len(r.Registry) != 0 {
+				args = append(args, "--insecure-registry", r.Registry)
+			}
 		}
 
 		for _, value := range vargs.Dns {
@@ -129,19 +184,11 @@ func main() {
 		time.Sleep(time.Second * 5)
 	}
 
-	// Login to Docker
-	if len(vargs.Username) != 0 {
-		cmd := exec.Command("/usr/bin/docker", "login", "-u", vargs.Username, "-p", vargs.Password, "-e", vargs.Email, vargs.Registry)
-		cmd.Dir = workspace.Path
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err := cmd.Run()
-		if err != nil {
-			fmt.Println("Login failed.")
-			os.Exit(1)
-		}
-	} else {
-		fmt.Printf("A username was not specified. Assuming anoynmous publishing.\n")
+	// Login to every registry by writing a single merged auth file,
+	// rather than shelling out to `docker login` once per registry.
+	if err := writeDockerConfig(registries); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 
 	// Docker environment info
@@ -173,12 +220,101 @@ func main() {
 		}
 	}
 
+	// Platforms switches the build to buildx, producing and pushing a
+	// manifest-list image that covers every requested architecture. This
+	// path builds and pushes in one step, so it exits here rather than
+	// falling through to the single-arch build/tag/push below. It still
+	// goes through the same registries and output plumbing as the
+	// single-arch path; Scan and Archive require a single local image to
+	// operate on, and Trust's base-image-pinning and push-signing both
+	// rely on CLI machinery buildx bypasses, so all three are rejected
+	// outright rather than silently skipped or left quietly inert.
+	if len(vargs.Platforms) != 0 {
+		if vargs.Scan.Enabled {
+			fmt.Println("scan is not supported with platforms: a multi-arch build has no single local image to scan before push")
+			os.Exit(1)
+		}
+		if len(vargs.Archive.File) != 0 {
+			fmt.Println("archive is not supported with platforms: a multi-arch manifest list cannot be saved to a single archive")
+			os.Exit(1)
+		}
+		if vargs.Trust.Enable {
+			fmt.Println("trust is not supported with platforms: docker buildx build doesn't consult DOCKER_CONTENT_TRUST, and the base-image digest pinning only covers the single-arch build path")
+			os.Exit(1)
+		}
+
+		started := time.Now()
+		digests, err := buildMultiArch(&vargs, registries, workspace.Path)
+		if err != nil {
+			os.Exit(1)
+		}
+		if err := writeMultiArchSummary(&vargs, registries, workspace.Path, started, digests); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Build the container
-	name := fmt.Sprintf("%s:%s", vargs.Repo, vargs.Tag.Slice()[0])
-	cmd = exec.Command("/usr/bin/docker", "build", "--pull=true", "--rm=true", "-f", vargs.File, "-t", name, vargs.Context)
+	started := time.Now()
+	if vargs.BuildKit {
+		pullCacheFrom(vargs.CacheFrom, workspace.Path)
+	}
+
+	// when Content Trust is enabled, pin every FROM base image to its
+	// signed, content-addressable digest before the build sees it, so an
+	// unsigned or tampered base image fails the build rather than the
+	// plugin merely noting it afterward.
+	dockerfile := vargs.File
+	if vargs.Trust.Enable {
+		path := vargs.File
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(workspace.Path, path)
+		}
+		trusted, err := resolveTrustedDockerfile(path, &vargs.Trust)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		dockerfile = trusted
+		if !filepath.IsAbs(vargs.File) {
+			if rel, err := filepath.Rel(workspace.Path, trusted); err == nil {
+				dockerfile = rel
+			}
+		}
+	}
+
+	repo := vargs.buildRepo()
+	name := fmt.Sprintf("%s:%s", repo, vargs.Tag.Slice()[0])
+
+	// --cache-to is buildx-only (see buildArgs), so a single-arch build
+	// that wants registry cache export has to go through `docker buildx
+	// build --load` instead of the classic builder, even though it isn't
+	// producing a multi-arch manifest list.
+	useBuildx := vargs.BuildKit && len(vargs.CacheTo) != 0
+	if useBuildx && !hasBuildx() {
+		fmt.Println("cache_to requires the buildx plugin, which is not available on this host")
+		os.Exit(1)
+	}
+
+	var buildArgs []string
+	if useBuildx {
+		buildArgs = []string{"buildx", "build", "--load", "--pull=true", "-f", dockerfile, "-t", name}
+	} else {
+		buildArgs = []string{"build", "--pull=true", "--rm=true", "-f", dockerfile, "-t", name}
+	}
+	buildArgs = append(buildArgs, vargs.buildArgs()...)
+	if useBuildx {
+		buildArgs = append(buildArgs, vargs.cacheToArgs()...)
+	}
+	buildArgs = append(buildArgs, vargs.Context)
+	cmd = exec.Command("/usr/bin/docker", buildArgs...)
 	cmd.Dir = workspace.Path
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	if vargs.BuildKit {
+		cmd.Env = append(os.Environ(), buildKitEnviron()...)
+	}
 	trace(cmd)
 	err := cmd.Run()
 	if err != nil {
@@ -187,7 +323,7 @@ func main() {
 
 	// Creates image tags
 	for _, tag := range vargs.Tag.Slice()[1:] {
-		name_ := fmt.Sprintf("%s:%s", vargs.Repo, tag)
+		name_ := fmt.Sprintf("%s:%s", repo, tag)
 		cmd = exec.Command("/usr/bin/docker", "tag", name, name_)
 		cmd.Dir = workspace.Path
 		cmd.Stdout = os.Stdout
@@ -199,20 +335,30 @@ func main() {
 		}
 	}
 
-	// Push the image and tags to the registry
-	for _, tag := range vargs.Tag.Slice() {
-		name_ := fmt.Sprintf("%s:%s", vargs.Repo, tag)
-		cmd = exec.Command("/usr/bin/docker", "push", name_)
-		cmd.Dir = workspace.Path
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		trace(cmd)
-		err = cmd.Run()
-		if err != nil {
+	// Scan the image and, when FailOnFindings is set, refuse to push if
+	// disallowed vulnerabilities were found.
+	if vargs.Scan.Enabled {
+		if err := vargs.Scan.run(name, workspace.Path); err != nil {
+			fmt.Println(err)
 			os.Exit(1)
 		}
 	}
 
+	// Push the image and tags to every configured registry
+	var pushEnv []string
+	if vargs.Trust.Enable {
+		pushEnv = vargs.Trust.environ()
+	}
+	if err := pushRegistries(name, repo, registries, vargs.Tag.Slice(), workspace.Path, pushEnv); err != nil {
+		os.Exit(1)
+	}
+
+	// Write the structured build summary for downstream deploy plugins
+	if err := writeBuildSummary(&vargs, repo, workspace.Path, name, started); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	// Save the image to the archive
 	if len(vargs.Archive.File) != 0 {
 		// if the path's directory does not exist, create it
@@ -224,11 +370,11 @@ func main() {
 		// Limit save command to the given tag(s)
 		if vargs.Archive.Tag.Len() != 0 {
 			for _, tag := range vargs.Archive.Tag.Slice() {
-				name_ := fmt.Sprintf("%s:%s", vargs.Repo, tag)
+				name_ := fmt.Sprintf("%s:%s", repo, tag)
 				cmd.Args = append(cmd.Args, name_)
 			}
 		} else {
-			cmd.Args = append(cmd.Args, vargs.Repo)
+			cmd.Args = append(cmd.Args, repo)
 		}
 
 		cmd.Dir = workspace.Path
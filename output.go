@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultOutputFile is the name of the structured build summary written
+// to the workspace, following the convention expected by downstream
+// deployment plugins.
+const defaultOutputFile = ".docker.json"
+
+// BuildSummary is the machine-readable record of a build/push, written
+// to Output (default .docker.json) so a later Drone step can promote
+// the exact, immutable image this step produced.
+type BuildSummary struct {
+	Repo       string            `json:"repo"`
+	Tags       []string          `json:"tags"`
+	Digests    map[string]string `json:"digests"`
+	Dockerfile string            `json:"dockerfile"`
+	SizeBytes  int64             `json:"size_bytes"`
+	DurationMs int64             `json:"duration_ms"`
+}
+
+// outputPath resolves where the summary should be written, defaulting
+// to .docker.json in the workspace.
+func outputPath(vargs *Docker, workspacePath string) string {
+	if len(vargs.Output) != 0 {
+		if filepath.IsAbs(vargs.Output) {
+			return vargs.Output
+		}
+		return filepath.Join(workspacePath, vargs.Output)
+	}
+	return filepath.Join(workspacePath, defaultOutputFile)
+}
+
+// imageDigest resolves the content-addressable digest docker recorded
+// for repo after ref was pushed, by reading it back out of the local
+// image. RepoDigests accumulates one entry per repo name the image has
+// ever been tagged/pushed under, so a multi-registry push leaves
+// several entries behind; the one matching repo must be picked out
+// rather than assuming index 0 is it.
+func imageDigest(ref, repo string) (string, error) {
+	out, err := exec.Command("/usr/bin/docker", "inspect", "--format={{json .RepoDigests}}", ref).Output()
+	if err != nil {
+		return "", err
+	}
+	var repoDigests []string
+	if err := json.Unmarshal(out, &repoDigests); err != nil {
+		return "", err
+	}
+	prefix := repo + "@"
+	for _, rd := range repoDigests {
+		if strings.HasPrefix(rd, prefix) {
+			return strings.TrimPrefix(rd, prefix), nil
+		}
+	}
+	return "", fmt.Errorf("no digest recorded for %s in %v", repo, repoDigests)
+}
+
+// imageSize returns the size in bytes docker reports for ref.
+func imageSize(ref string) (int64, error) {
+	out, err := exec.Command("/usr/bin/docker", "inspect", "--format={{.Size}}", ref).Output()
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	if _, err := fmt.Sscanf(string(out), "%d", &size); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// remoteDigest resolves the digest of a manifest-list image that was
+// pushed via buildx, which (unlike a single-arch image) is never loaded
+// into the local image store for `docker inspect` to read back.
+func remoteDigest(ref string) (string, error) {
+	out, err := exec.Command("/usr/bin/docker", "buildx", "imagetools", "inspect", ref).Output()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "Digest:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "Digest:")), nil
+		}
+	}
+	return "", fmt.Errorf("no digest found for %s", ref)
+}
+
+// writeMultiArchSummary is the Platforms-path equivalent of
+// writeBuildSummary: it covers the manifest list pushed to the primary
+// registry. digests (tag -> digest) comes from whichever of
+// buildxBuild/buildManifestFallback actually built the image, since
+// only that function knows which digest-resolution mechanism applies.
+// SizeBytes is left at 0 since a manifest list has no single "image
+// size" the way a single-arch image does.
+func writeMultiArchSummary(vargs *Docker, registries []RegistryConfig, workspacePath string, started time.Time, digests map[string]string) error {
+	if vargs.DisableOutput {
+		return nil
+	}
+
+	repo := registries[0].repo(vargs.Repo)
+	tags := vargs.Tag.Slice()
+
+	summary := BuildSummary{
+		Repo:       repo,
+		Tags:       tags,
+		Digests:    digests,
+		Dockerfile: vargs.File,
+		DurationMs: time.Since(started).Milliseconds(),
+	}
+
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(outputPath(vargs, workspacePath), data, 0644)
+}
+
+// writeBuildSummary assembles a BuildSummary for the image that was just
+// built and pushed, and writes it to vargs.Output (or .docker.json).
+// repo is the resolved local build repo (see Docker.buildRepo), not the
+// possibly-unset legacy vargs.Repo.
+func writeBuildSummary(vargs *Docker, repo, workspacePath, name string, started time.Time) error {
+	if vargs.DisableOutput {
+		return nil
+	}
+
+	tags := vargs.Tag.Slice()
+	digests := map[string]string{}
+	for _, tag := range tags {
+		ref := fmt.Sprintf("%s:%s", repo, tag)
+		digest, err := imageDigest(ref, repo)
+		if err != nil {
+			continue
+		}
+		digests[tag] = digest
+	}
+
+	size, _ := imageSize(name)
+
+	summary := BuildSummary{
+		Repo:       repo,
+		Tags:       tags,
+		Digests:    digests,
+		Dockerfile: vargs.File,
+		SizeBytes:  size,
+		DurationMs: time.Since(started).Milliseconds(),
+	}
+
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(outputPath(vargs, workspacePath), data, 0644)
+}
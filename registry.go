@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// dockerPushConcurrency bounds how many `docker push` commands run at
+// once when fanning out to multiple registries.
+const dockerPushConcurrency = 4
+
+// dockerConfigPath is where the merged multi-registry auth file is
+// written, matching the location the docker client itself reads from.
+const dockerConfigPath = "/root/.docker/config.json"
+
+// defaultRegistry is Docker Hub's legacy v1 index URL. It is the literal
+// string the docker client looks up in config.json's "auths" map for an
+// unqualified repo name (e.g. `user/app`), so it must be kept verbatim
+// as the auth key rather than normalized down to its host.
+const defaultRegistry = "https://index.docker.io/v1/"
+
+// RegistryConfig describes a single registry (or mirror) that the built
+// image should be tagged and pushed to.
+type RegistryConfig struct {
+	Registry string `json:"registry"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Insecure bool   `json:"insecure"`
+	Cert     string `json:"cert"`
+	Repo     string `json:"repo"`
+}
+
+type dockerAuthEntry struct {
+	Auth string `json:"auth"`
+}
+
+type dockerConfigFile struct {
+	Auths map[string]dockerAuthEntry `json:"auths"`
+}
+
+// registries resolves the list of registries this build should push to.
+// When no Registries are configured it falls back to the legacy
+// top-level Registry/Username/Password/Repo fields so existing .drone.yml
+// files keep working unmodified.
+func (d *Docker) registries() []RegistryConfig {
+	if len(d.Registries) != 0 {
+		return d.Registries
+	}
+	return []RegistryConfig{
+		{
+			Registry: d.Registry,
+			Username: d.Username,
+			Password: d.Password,
+			Insecure: d.Insecure,
+			Cert:     d.Cert,
+			Repo:     d.Repo,
+		},
+	}
+}
+
+// repo returns the repository this registry entry should push to,
+// falling back to the build's default repo when no override is set.
+func (r *RegistryConfig) repo(defaultRepo string) string {
+	if len(r.Repo) != 0 {
+		return r.Repo
+	}
+	return defaultRepo
+}
+
+// buildRepo resolves the repository the plugin builds and tags the
+// local image under. It no longer assumes the legacy top-level Repo is
+// set: a build configured entirely through Registries (each carrying
+// its own repo override) works standalone, with the first registry's
+// resolved repo used as the local build tag.
+func (d *Docker) buildRepo() string {
+	return d.registries()[0].repo(d.Repo)
+}
+
+// writeDockerConfig merges the credentials for every registry into a
+// single ~/.docker/config.json, the same file the docker client
+// consults on every pull, tag and push.
+func writeDockerConfig(registries []RegistryConfig) error {
+	auths := map[string]dockerAuthEntry{}
+	for _, r := range registries {
+		if len(r.Username) == 0 {
+			continue
+		}
+		// Docker Hub is the one registry docker's credential lookup
+		// keys on the full index URL, not the host, so it must be left
+		// un-normalized to keep working for unqualified repo names.
+		host := r.Registry
+		if r.Registry != defaultRegistry {
+			if uri, err := url.Parse(r.Registry); err == nil && len(uri.Host) != 0 {
+				host = uri.Host
+			}
+		}
+		raw := fmt.Sprintf("%s:%s", r.Username, r.Password)
+		auths[host] = dockerAuthEntry{Auth: base64.StdEncoding.EncodeToString([]byte(raw))}
+	}
+	if len(auths) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(dockerConfigFile{Auths: auths})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll("/root/.docker", 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dockerConfigPath, data, 0600)
+}
+
+// pushRegistries tags `name` once per (registry, repo, tag) tuple and
+// pushes the results, bounding concurrency so we don't overwhelm the
+// docker daemon with simultaneous pushes.
+func pushRegistries(name, defaultRepo string, registries []RegistryConfig, tags []string, dir string, env []string) error {
+	type job struct {
+		registry RegistryConfig
+		tag      string
+	}
+
+	var jobs []job
+	for _, r := range registries {
+		for _, tag := range tags {
+			jobs = append(jobs, job{registry: r, tag: tag})
+		}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		sem      = make(chan struct{}, dockerPushConcurrency)
+	)
+
+	for _, j := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(j job) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			target := fmt.Sprintf("%s:%s", j.registry.repo(defaultRepo), j.tag)
+
+			cmd := exec.Command("/usr/bin/docker", "tag", name, target)
+			cmd.Dir = dir
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			trace(cmd)
+			if err := cmd.Run(); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				return
+			}
+
+			cmd = exec.Command("/usr/bin/docker", "push", target)
+			cmd.Dir = dir
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			if len(env) != 0 {
+				cmd.Env = append(os.Environ(), env...)
+			}
+			trace(cmd)
+			if err := cmd.Run(); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(j)
+	}
+
+	wg.Wait()
+	return firstErr
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Scan configures a vulnerability scan of the freshly built local image,
+// run after the build and before any docker push.
+type Scan struct {
+	Enabled        bool     `json:"enabled"`
+	Severity       []string `json:"severity"`
+	IgnoreUnfixed  bool     `json:"ignore_unfixed"`
+	FailOnFindings bool     `json:"fail_on_findings"`
+	ReportFile     string   `json:"report_file"`
+}
+
+// trivyReport mirrors the subset of `trivy image --format json` this
+// plugin cares about: a top-level object with one Result per target,
+// each with a list of vulnerabilities.
+type trivyReport struct {
+	Results []struct {
+		Vulnerabilities []struct {
+			VulnerabilityID  string `json:"VulnerabilityID"`
+			PkgName          string `json:"PkgName"`
+			Severity         string `json:"Severity"`
+			FixedVersion     string `json:"FixedVersion"`
+			InstalledVersion string `json:"InstalledVersion"`
+		} `json:"Vulnerabilities"`
+	} `json:"Results"`
+}
+
+// reportPath resolves where the JSON scan report should be written,
+// defaulting to a file in the workspace.
+func (s *Scan) reportPath(workspacePath string) string {
+	if len(s.ReportFile) == 0 {
+		return filepath.Join(workspacePath, "trivy-report.json")
+	}
+	if filepath.IsAbs(s.ReportFile) {
+		return s.ReportFile
+	}
+	return filepath.Join(workspacePath, s.ReportFile)
+}
+
+// run scans name with trivy, writes the JSON report to disk, prints a
+// human-readable summary table, and returns an error if FailOnFindings
+// is set and any disallowed severity was found.
+func (s *Scan) run(name, workspacePath string) error {
+	severities := s.Severity
+	if len(severities) == 0 {
+		severities = []string{"CRITICAL", "HIGH"}
+	}
+	severity := strings.Join(severities, ",")
+
+	args := []string{"image", "--format", "json", "--exit-code", "1", "--severity", severity}
+	if s.IgnoreUnfixed {
+		args = append(args, "--ignore-unfixed")
+	}
+	args = append(args, name)
+
+	cmd := exec.Command("trivy", args...)
+	cmd.Stderr = os.Stderr
+	trace(cmd)
+	out, runErr := cmd.Output()
+	if runErr != nil {
+		if _, ok := runErr.(*exec.ExitError); !ok {
+			return fmt.Errorf("scan failed: %s", runErr)
+		}
+	}
+
+	if err := ioutil.WriteFile(s.reportPath(workspacePath), out, 0644); err != nil {
+		return err
+	}
+
+	var report trivyReport
+	if err := json.Unmarshal(out, &report); err != nil {
+		return fmt.Errorf("unable to parse scan report: %s", err)
+	}
+
+	counts := map[string]int{}
+	total := 0
+	fmt.Println("SEVERITY  PACKAGE              INSTALLED       FIXED           VULNERABILITY")
+	for _, result := range report.Results {
+		for _, v := range result.Vulnerabilities {
+			counts[v.Severity]++
+			total++
+			fmt.Printf("%-9s %-20s %-15s %-15s %s\n",
+				v.Severity, v.PkgName, v.InstalledVersion, v.FixedVersion, v.VulnerabilityID)
+		}
+	}
+	for _, sev := range severities {
+		fmt.Printf("%s: %d\n", sev, counts[sev])
+	}
+
+	if s.FailOnFindings && total > 0 {
+		return fmt.Errorf("%d vulnerabilities found at severity %s, refusing to push", total, severity)
+	}
+	return nil
+}
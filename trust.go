@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ContentTrust configures Docker Content Trust (Notary) signing for the
+// image being built. When Enable is set, the plugin exports the
+// DOCKER_CONTENT_TRUST family of environment variables on every docker
+// push, so pushes are signed, and on the pull of each FROM base image,
+// so those pulls are verified. Other docker commands run without them.
+type ContentTrust struct {
+	Enable         bool   `json:"enable"`
+	Server         string `json:"server"`
+	RootKey        string `json:"root_key"`
+	RepositoryKey  string `json:"repository_key"`
+	TargetKey      string `json:"target_key"`
+	RootPass       string `json:"root_passphrase"`
+	RepositoryPass string `json:"repository_passphrase"`
+	TargetPass     string `json:"target_passphrase"`
+}
+
+// trustDir is the location docker reads/writes Notary private keys from.
+const trustDir = "/root/.docker/trust/private"
+
+// environ returns the DOCKER_CONTENT_TRUST_* environment variables that
+// are added to docker push and to the trusted base-image pull while
+// trust is enabled.
+func (t *ContentTrust) environ() []string {
+	env := []string{"DOCKER_CONTENT_TRUST=1"}
+	if len(t.Server) != 0 {
+		env = append(env, fmt.Sprintf("DOCKER_CONTENT_TRUST_SERVER=%s", t.Server))
+	}
+	if len(t.RootPass) != 0 {
+		env = append(env, fmt.Sprintf("DOCKER_CONTENT_TRUST_ROOT_PASSPHRASE=%s", t.RootPass))
+	}
+	if len(t.RepositoryPass) != 0 {
+		env = append(env, fmt.Sprintf("DOCKER_CONTENT_TRUST_REPOSITORY_PASSPHRASE=%s", t.RepositoryPass))
+	}
+	if len(t.TargetPass) != 0 {
+		// notary has no separate target passphrase, it reuses the
+		// repository passphrase, but some daemons still look for this.
+		env = append(env, fmt.Sprintf("DOCKER_CONTENT_TRUST_REPOSITORY_PASSPHRASE=%s", t.TargetPass))
+	}
+	return env
+}
+
+// installKeys writes any inline PEM key material to the Notary private
+// key directory with 0600 perms so the docker client can find it. It
+// returns the list of files it wrote so they can be removed on exit.
+func (t *ContentTrust) installKeys() ([]string, error) {
+	if err := os.MkdirAll(trustDir, 0700); err != nil {
+		return nil, err
+	}
+
+	var written []string
+	keys := map[string]string{
+		"root.key":       t.RootKey,
+		"repository.key": t.RepositoryKey,
+		"target.key":     t.TargetKey,
+	}
+	for name, pem := range keys {
+		if len(pem) == 0 {
+			continue
+		}
+		path := filepath.Join(trustDir, name)
+		if err := ioutil.WriteFile(path, []byte(pem), 0600); err != nil {
+			return written, err
+		}
+		written = append(written, path)
+	}
+	return written, nil
+}
+
+// cleanupKeys removes any inline key material that was written to disk.
+func cleanupKeys(paths []string) {
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+// trustedPull resolves repo:tag to a signed, content-addressable digest.
+// It fails if the tag has no valid signature, guaranteeing the image the
+// plugin builds FROM came from Notary, not a mutable tag.
+func trustedPull(repo, tag string, trust *ContentTrust) (string, error) {
+	name := fmt.Sprintf("%s:%s", repo, tag)
+
+	cmd := exec.Command("/usr/bin/docker", "pull", name)
+	cmd.Env = append(os.Environ(), trust.environ()...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	trace(cmd)
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("no valid signature for %s: %s", name, err)
+	}
+
+	out, err := exec.Command("/usr/bin/docker", "inspect", "--format={{json .RepoDigests}}", name).Output()
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve digest for %s: %s", name, err)
+	}
+	var repoDigests []string
+	if err := json.Unmarshal(out, &repoDigests); err != nil {
+		return "", fmt.Errorf("unable to resolve digest for %s: %s", name, err)
+	}
+	prefix := repo + "@"
+	for _, rd := range repoDigests {
+		if strings.HasPrefix(rd, prefix) {
+			return strings.TrimPrefix(rd, prefix), nil
+		}
+	}
+	return "", fmt.Errorf("no digest recorded for %s in %v", repo, repoDigests)
+}
+
+// resolveTrustedDockerfile rewrites every FROM line that references a
+// registry image (as opposed to an earlier build stage) to pull the
+// base image by its Notary-signed digest instead of its mutable tag.
+// The original Dockerfile is left untouched; the rewritten copy, which
+// the build should use instead, is written alongside it.
+func resolveTrustedDockerfile(path string, trust *ContentTrust) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	lines := strings.Split(string(data), "\n")
+	stages := map[string]bool{}
+
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+
+		idx := 1
+		for idx < len(fields) && strings.HasPrefix(fields[idx], "--") {
+			idx++
+		}
+		if idx >= len(fields) {
+			continue
+		}
+		ref := fields[idx]
+
+		var alias string
+		if idx+2 < len(fields) && strings.EqualFold(fields[idx+1], "AS") {
+			alias = strings.ToLower(fields[idx+2])
+		}
+
+		// a FROM referencing an earlier stage, or already pinned to a
+		// digest, needs no trust resolution.
+		if stages[strings.ToLower(ref)] || strings.Contains(ref, "@") {
+			if len(alias) != 0 {
+				stages[alias] = true
+			}
+			continue
+		}
+
+		repo, tag := ref, "latest"
+		if at := strings.LastIndex(ref, ":"); at != -1 && !strings.Contains(ref[at:], "/") {
+			repo, tag = ref[:at], ref[at+1:]
+		}
+
+		digest, err := trustedPull(repo, tag, trust)
+		if err != nil {
+			return "", err
+		}
+		fields[idx] = fmt.Sprintf("%s@%s", repo, digest)
+		lines[i] = strings.Join(fields, " ")
+
+		if len(alias) != 0 {
+			stages[alias] = true
+		}
+	}
+
+	trusted := path + ".trusted"
+	if err := ioutil.WriteFile(trusted, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		return "", err
+	}
+	return trusted, nil
+}